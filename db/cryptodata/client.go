@@ -15,35 +15,124 @@
 package cryptodata
 
 import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/rsa"
 	"github.com/ligato/cn-infra/db/keyval"
+	"github.com/ligato/cn-infra/logging/logrus"
 	"errors"
 	"crypto/rand"
 	"io"
+	"bytes"
 	"encoding/base64"
+	"encoding/binary"
 	"hash"
 	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+const (
+	// watchRetryMinBackoff is the initial delay before retrying a
+	// KeyProvider.Watch call that returned an error.
+	watchRetryMinBackoff = 1 * time.Second
+	// watchRetryMaxBackoff caps the exponential backoff between retries.
+	watchRetryMaxBackoff = 1 * time.Minute
+)
+
+// FormatTag is a one-byte, self-describing format identifier following
+// formatMagic in data produced by Encrypt/EncryptDataEnvelope, so DecryptData
+// can tell how to interpret the bytes that follow it.
+type FormatTag byte
+
+const (
+	// FormatLegacyOAEP marks data encrypted with plain RSA-OAEP, i.e. the
+	// same bytes EncryptData has always produced, just prefixed with
+	// formatMagic and the tag.
+	FormatLegacyOAEP FormatTag = 0x01
+	// FormatEnvelope marks data encrypted with the hybrid RSA+AES-GCM
+	// envelope scheme produced by EncryptDataEnvelope.
+	FormatEnvelope FormatTag = 0x02
+)
+
+// formatMagic prefixes every tagged blob written by Encrypt/
+// EncryptDataEnvelope. A single tag byte is not safe to sniff on its own:
+// plain RSA-OAEP ciphertext (what the original, untagged EncryptData
+// produces) is effectively random bytes, so roughly 1 in 256 pre-existing
+// stored values would happen to start with a byte that collides with a
+// FormatTag value. A 4-byte magic cuts that collision chance to 1 in 2^32,
+// which is the backward-compatibility guarantee DecryptData relies on to
+// tell tagged data apart from untagged legacy ciphertext.
+var formatMagic = []byte{0xc0, 0xde, 0xca, 0xfe}
+
+const (
+	envelopeAESKeySize = 32 // AES-256
+	envelopeNonceSize  = 12 // AES-GCM standard nonce size
 )
 
 // ClientConfig is result of converting Config.PrivateKeyFile to PrivateKey
 type ClientConfig struct {
 	// Private key is used to decrypt encrypted keys while reading them from store
 	PrivateKeys []*rsa.PrivateKey
+	// KeyProviders supply additional private keys from external sources (e.g. Vault).
+	// Keys returned by providers are combined with the statically configured
+	// PrivateKeys on every DecryptData call and refreshed in the background
+	// as providers rotate them.
+	KeyProviders []KeyProvider
 	// Reader used for encrypting/decrypting
 	Reader io.Reader
 	// Hash function used for hashing while encrypting
 	Hash hash.Hash
+	// DefaultMode selects the on-wire format that Encrypt produces. Defaults
+	// to FormatEnvelope. It only governs direct Encrypt/EncryptDataEnvelope
+	// calls: Wrap's pre-existing NewCoreBrokerWatcherWrapper only wraps
+	// reads, so callers that want Wrap-installed writes to use this format
+	// must call Encrypt themselves on their write path; see Wrap.
+	// DecryptData keeps reading both formats plus untagged values written
+	// by the original EncryptData regardless of this setting.
+	DefaultMode FormatTag
+	// Decrypters are additional, non-*rsa.PrivateKey sources of RSA-OAEP
+	// decryption, e.g. keys bound to an HSM via PKCS#11. DecryptData tries
+	// them alongside PrivateKeys and KeyProviders.
+	Decrypters []Decrypter
+}
+
+// Decrypter abstracts RSA-OAEP decryption of an opaque ciphertext, so that
+// Client.DecryptData can iterate over a mixture of in-memory *rsa.PrivateKey
+// values and keys that never leave an HSM.
+type Decrypter interface {
+	// Decrypt returns the plaintext for ciphertext, which was produced by
+	// RSA-OAEP encryption under the Decrypter's corresponding public key.
+	// Implementations return an error if ciphertext was not encrypted for
+	// their key; Client tries the next Decrypter in that case.
+	Decrypt(ciphertext []byte) ([]byte, error)
+}
+
+// rsaDecrypter adapts an in-memory *rsa.PrivateKey to the Decrypter interface.
+type rsaDecrypter struct {
+	key    *rsa.PrivateKey
+	hash   hash.Hash
+	reader io.Reader
+}
+
+func (d *rsaDecrypter) Decrypt(ciphertext []byte) ([]byte, error) {
+	return rsa.DecryptOAEP(d.hash, d.reader, d.key, ciphertext, nil)
 }
 
 // Client handles encrypting/decrypting and wrapping data
 type Client struct {
 	ClientConfig
+
+	providerKeysMu sync.RWMutex
+	providerKeys   map[KeyProvider][]*rsa.PrivateKey
 }
 
 // NewClient creates new client from provided config and reader
 func NewClient(clientConfig ClientConfig) (client *Client) {
 	client = &Client{
 		ClientConfig: clientConfig,
+		providerKeys: make(map[KeyProvider][]*rsa.PrivateKey),
 	}
 
 	// If reader is nil use default rand.Reader
@@ -56,26 +145,252 @@ func NewClient(clientConfig ClientConfig) (client *Client) {
 		client.Hash = sha256.New()
 	}
 
+	// Default new writes to the envelope format; DecryptData still reads
+	// legacy and untagged values regardless of this setting.
+	if client.DefaultMode == 0 {
+		client.DefaultMode = FormatEnvelope
+	}
+
 	return
 }
 
-// EncryptData encrypts input data using provided public key
+// Init fetches the initial set of keys from all configured KeyProviders and
+// starts a background watch for each of them so that keys rotated in the
+// external store (e.g. a new Vault secret version) are picked up without
+// restarting the agent. It should be called once after NewClient, before
+// DecryptData is used, whenever KeyProviders are configured.
+func (client *Client) Init(ctx context.Context) error {
+	for _, provider := range client.KeyProviders {
+		if err := client.refreshProviderKeys(ctx, provider); err != nil {
+			return err
+		}
+
+		provider := provider
+		go client.watchProvider(ctx, provider)
+	}
+
+	return nil
+}
+
+// watchProvider runs provider.Watch until ctx is done, logging and retrying
+// with capped exponential backoff whenever it returns an error. Without
+// this, a transient failure in the provider's rotation loop (e.g. a Vault
+// renewal and re-login both failing) would silently and permanently stop
+// key rotation, leaving the client running on stale keys forever.
+func (client *Client) watchProvider(ctx context.Context, provider KeyProvider) {
+	backoff := watchRetryMinBackoff
+	for {
+		err := provider.Watch(ctx, func() {
+			_ = client.refreshProviderKeys(ctx, provider)
+		})
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+
+		logrus.DefaultLogger().Warnf("cryptodata: key provider watch stopped, retrying in %s: %v", backoff, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+
+		if backoff *= 2; backoff > watchRetryMaxBackoff {
+			backoff = watchRetryMaxBackoff
+		}
+	}
+}
+
+func (client *Client) refreshProviderKeys(ctx context.Context, provider KeyProvider) error {
+	keys, err := provider.PrivateKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	client.providerKeysMu.Lock()
+	client.providerKeys[provider] = keys
+	client.providerKeysMu.Unlock()
+
+	return nil
+}
+
+// allPrivateKeys returns the statically configured PrivateKeys together with
+// the latest keys fetched from all KeyProviders.
+func (client *Client) allPrivateKeys() []*rsa.PrivateKey {
+	client.providerKeysMu.RLock()
+	defer client.providerKeysMu.RUnlock()
+
+	keys := make([]*rsa.PrivateKey, 0, len(client.PrivateKeys))
+	keys = append(keys, client.PrivateKeys...)
+	for _, providerKeys := range client.providerKeys {
+		keys = append(keys, providerKeys...)
+	}
+
+	return keys
+}
+
+// allDecrypters returns a Decrypter for every statically configured and
+// provider-supplied PrivateKey, together with the explicitly configured
+// Decrypters (e.g. HSM-bound keys).
+func (client *Client) allDecrypters() []Decrypter {
+	keys := client.allPrivateKeys()
+
+	decrypters := make([]Decrypter, 0, len(keys)+len(client.Decrypters))
+	for _, key := range keys {
+		decrypters = append(decrypters, &rsaDecrypter{key: key, hash: client.Hash, reader: client.Reader})
+	}
+	decrypters = append(decrypters, client.Decrypters...)
+
+	return decrypters
+}
+
+// EncryptData encrypts input data using provided public key.
+//
+// This is the legacy call: it always produces a plain RSA-OAEP ciphertext
+// with no format tag, exactly as before envelope encryption was introduced.
+// RSA-OAEP can only encrypt payloads smaller than the RSA key size, so for
+// larger or performance-sensitive payloads use EncryptDataEnvelope instead.
 func (client *Client) EncryptData(inData []byte, pub *rsa.PublicKey) (data []byte, err error) {
 	data, err = rsa.EncryptOAEP(client.Hash, client.Reader, pub, inData, nil)
 	data = []byte(base64.URLEncoding.EncodeToString(data))
 	return
 }
 
-// DecryptData decrypts input data
+// EncryptDataEnvelope encrypts inData using hybrid RSA+AES-GCM envelope
+// encryption: a fresh AES-256 key and 96-bit nonce are generated per call,
+// the payload is encrypted with AES-GCM, and only the AES key is wrapped
+// with RSA-OAEP under pub. The result is self-describing, prefixed with
+// formatMagic and FormatEnvelope, so DecryptData can tell it apart from
+// plain RSA-OAEP data.
+// Unlike EncryptData, this supports payloads of any size.
+func (client *Client) EncryptDataEnvelope(inData []byte, pub *rsa.PublicKey) (data []byte, err error) {
+	aesKey := make([]byte, envelopeAESKeySize)
+	if _, err = io.ReadFull(client.Reader, aesKey); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, envelopeNonceSize)
+	if _, err = io.ReadFull(client.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	ciphertext := gcm.Seal(nil, nonce, inData, nil)
+
+	wrappedKey, err := rsa.EncryptOAEP(client.Hash, client.Reader, pub, aesKey, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	blob := encodeEnvelope(wrappedKey, nonce, ciphertext)
+	return []byte(base64.URLEncoding.EncodeToString(blob)), nil
+}
+
+// Encrypt encrypts inData according to client.DefaultMode, writing either a
+// tagged legacy RSA-OAEP blob or an envelope blob. It is not called by Wrap;
+// callers that want the broker/watcher write path to use it need to call it
+// explicitly when writing values.
+func (client *Client) Encrypt(inData []byte, pub *rsa.PublicKey) (data []byte, err error) {
+	switch client.DefaultMode {
+	case FormatEnvelope:
+		return client.EncryptDataEnvelope(inData, pub)
+	default:
+		ciphertext, err := rsa.EncryptOAEP(client.Hash, client.Reader, pub, inData, nil)
+		if err != nil {
+			return nil, err
+		}
+		blob := append(taggedPrefix(FormatLegacyOAEP), ciphertext...)
+		return []byte(base64.URLEncoding.EncodeToString(blob)), nil
+	}
+}
+
+// taggedPrefix returns formatMagic followed by tag, the header every tagged
+// blob starts with.
+func taggedPrefix(tag FormatTag) []byte {
+	return append(append([]byte{}, formatMagic...), byte(tag))
+}
+
+// DecryptData decrypts input data. It recognizes three on-wire formats:
+// untagged data written by the original EncryptData, FormatLegacyOAEP data
+// written by Encrypt, and FormatEnvelope data written by
+// EncryptDataEnvelope. The latter two are identified by formatMagic, not by
+// a single byte, so they cannot be confused with untagged RSA-OAEP
+// ciphertext (which is effectively random bytes and could otherwise
+// coincidentally start with a valid tag byte). Each configured Decrypter
+// (an in-memory private key, a KeyProvider-supplied key, or an HSM-bound
+// key) is tried in turn until one succeeds.
 func (client *Client) DecryptData(inData []byte) (data []byte, err error) {
 	inData, err = base64.URLEncoding.DecodeString(string(inData))
 	if err != nil {
 		return
 	}
 
-	for _, key := range client.PrivateKeys {
-		data, err := rsa.DecryptOAEP(client.Hash, client.Reader, key, inData, nil)
+	if len(inData) == 0 {
+		return nil, errors.New("failed to decrypt data due to empty payload")
+	}
+
+	decrypters := client.allDecrypters()
+
+	headerLen := len(formatMagic) + 1
+	if len(inData) >= headerLen && bytes.Equal(inData[:len(formatMagic)], formatMagic) {
+		tag := FormatTag(inData[len(formatMagic)])
+		body := inData[headerLen:]
+
+		switch tag {
+		case FormatEnvelope:
+			wrappedKey, nonce, ciphertext, err := decodeEnvelope(body)
+			if err != nil {
+				return nil, err
+			}
+			return decryptEnvelope(decrypters, wrappedKey, nonce, ciphertext)
+
+		case FormatLegacyOAEP:
+			return decryptOAEP(decrypters, body)
+		}
+	}
+
+	// Values written before format tags existed (or anything else that
+	// doesn't start with formatMagic): the whole payload is the raw
+	// RSA-OAEP ciphertext, exactly as the original EncryptData produced.
+	return decryptOAEP(decrypters, inData)
+}
+
+func decryptOAEP(decrypters []Decrypter, ciphertext []byte) ([]byte, error) {
+	for _, decrypter := range decrypters {
+		data, err := decrypter.Decrypt(ciphertext)
+		if err == nil {
+			return data, nil
+		}
+	}
+
+	return nil, errors.New("failed to decrypt data due to no private key matching")
+}
+
+func decryptEnvelope(decrypters []Decrypter, wrappedKey, nonce, ciphertext []byte) ([]byte, error) {
+	for _, decrypter := range decrypters {
+		aesKey, err := decrypter.Decrypt(wrappedKey)
+		if err != nil {
+			continue
+		}
+
+		block, err := aes.NewCipher(aesKey)
+		if err != nil {
+			continue
+		}
+		gcm, err := cipher.NewGCM(block)
+		if err != nil {
+			continue
+		}
 
+		data, err := gcm.Open(nil, nonce, ciphertext, nil)
 		if err == nil {
 			return data, nil
 		}
@@ -84,7 +399,63 @@ func (client *Client) DecryptData(inData []byte) (data []byte, err error) {
 	return nil, errors.New("failed to decrypt data due to no private key matching")
 }
 
-// Wrap wraps core broker watcher with support for decrypting encrypted keys
+// encodeEnvelope lays out formatMagic, the FormatEnvelope tag, and
+// wrappedKey, nonce and ciphertext as length-prefixed fields, each preceded
+// by a uint32 big-endian length.
+func encodeEnvelope(wrappedKey, nonce, ciphertext []byte) []byte {
+	buf := make([]byte, 0, len(formatMagic)+1+3*4+len(wrappedKey)+len(nonce)+len(ciphertext))
+	buf = append(buf, taggedPrefix(FormatEnvelope)...)
+	buf = appendLengthPrefixed(buf, wrappedKey)
+	buf = appendLengthPrefixed(buf, nonce)
+	buf = appendLengthPrefixed(buf, ciphertext)
+	return buf
+}
+
+func appendLengthPrefixed(buf, field []byte) []byte {
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(field)))
+	buf = append(buf, length[:]...)
+	return append(buf, field...)
+}
+
+// decodeEnvelope parses the body written by encodeEnvelope (body excludes
+// the leading formatMagic+tag header).
+func decodeEnvelope(body []byte) (wrappedKey, nonce, ciphertext []byte, err error) {
+	wrappedKey, body, err = readLengthPrefixed(body)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	nonce, body, err = readLengthPrefixed(body)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	ciphertext, _, err = readLengthPrefixed(body)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return wrappedKey, nonce, ciphertext, nil
+}
+
+func readLengthPrefixed(buf []byte) (field, rest []byte, err error) {
+	if len(buf) < 4 {
+		return nil, nil, errors.New("malformed envelope: missing length prefix")
+	}
+	length := binary.BigEndian.Uint32(buf[:4])
+	buf = buf[4:]
+	if uint64(len(buf)) < uint64(length) {
+		return nil, nil, errors.New("malformed envelope: field shorter than length prefix")
+	}
+	return buf[:length], buf[length:], nil
+}
+
+// Wrap wraps core broker watcher with support for decrypting encrypted
+// keys, via the existing NewCoreBrokerWatcherWrapper. That helper only
+// wraps reads: it installs client.DecryptData to transparently decrypt
+// values as they come back through Get/Watch, but it does not touch the
+// broker's write path, so Put calls through the wrapped broker/watcher are
+// not encrypted and DefaultMode has no effect on them. Callers that want
+// writes in DefaultMode's format must call Encrypt themselves before
+// writing through cbw.
 func (client *Client) Wrap(cbw keyval.CoreBrokerWatcher, decrypter ArbitraryDecrypter) keyval.CoreBrokerWatcher {
 	return NewCoreBrokerWatcherWrapper(cbw, decrypter, client.DecryptData)
 }
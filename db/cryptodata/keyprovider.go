@@ -0,0 +1,36 @@
+//  Copyright (c) 2019 Cisco and/or its affiliates.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at:
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package cryptodata
+
+import (
+	"context"
+	"crypto/rsa"
+)
+
+// KeyProvider is a source of private keys that are not statically configured
+// on the agent host. Implementations are expected to fetch keys from an
+// external secret store (e.g. Hashicorp Vault, an HSM) so that the keys
+// themselves never need to be placed on disk.
+type KeyProvider interface {
+	// PrivateKeys returns the current set of private keys known to the provider.
+	PrivateKeys(ctx context.Context) ([]*rsa.PrivateKey, error)
+
+	// Watch blocks until ctx is cancelled or an unrecoverable error occurs,
+	// calling onRotate whenever the underlying keys change (e.g. a new secret
+	// version is written, or a lease is renewed with new key material).
+	// Callers that receive onRotate should call PrivateKeys again to fetch
+	// the updated keys.
+	Watch(ctx context.Context, onRotate func()) error
+}
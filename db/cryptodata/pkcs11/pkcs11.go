@@ -0,0 +1,295 @@
+//  Copyright (c) 2019 Cisco and/or its affiliates.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at:
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+// Package pkcs11 implements a cryptodata.Decrypter backed by a PKCS#11
+// module (an HSM or a software token such as SoftHSM). The private key
+// never leaves the token: decryption is delegated to C_DecryptInit/C_Decrypt
+// using CKM_RSA_PKCS_OAEP, and only the public key is extracted into Go so
+// that callers can keep encrypting with the pure Go cryptodata.Client.
+//
+// The cryptodata.ClientConfig.Hash used to drive cryptodata encryption must
+// match the hash and MGF parameters configured here, otherwise the HSM will
+// reject the ciphertext or produce garbage.
+package pkcs11
+
+import (
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+)
+
+// Config configures the PKCS#11-backed Decrypter.
+type Config struct {
+	// ModulePath is the path to the PKCS#11 shared library (.so) to load.
+	ModulePath string `json:"module-path"`
+	// TokenLabel identifies the token/slot to open.
+	TokenLabel string `json:"token-label"`
+	// UserPIN authenticates to the token as CKU_USER.
+	UserPIN string `json:"user-pin"`
+	// KeyLabel is the CKA_LABEL of the RSA private (and public) key object.
+	KeyLabel string `json:"key-label"`
+	// SessionPoolSize bounds how many idle PKCS#11 sessions are kept open in
+	// the pool for reuse; when all pooled sessions are in use, further ones
+	// are opened on demand. Defaults to 4.
+	SessionPoolSize int `json:"session-pool-size"`
+}
+
+// Decrypter is a cryptodata.Decrypter that performs RSA-OAEP decryption on
+// a PKCS#11 token, pooling sessions since they are not safe for concurrent
+// use by multiple goroutines.
+type Decrypter struct {
+	cfg Config
+	ctx *pkcs11.Ctx
+
+	slot      uint
+	keyHandle pkcs11.ObjectHandle
+
+	// PublicKey is the RSA public key extracted from the token at startup.
+	// It can be used to encrypt with the pure Go cryptodata.Client so that
+	// only decryption needs the HSM.
+	PublicKey *rsa.PublicKey
+
+	mu       sync.Mutex
+	sessions []pkcs11.SessionHandle
+}
+
+// NewDecrypter opens the PKCS#11 module, logs in, locates the key by label
+// and extracts its public key.
+func NewDecrypter(cfg Config) (*Decrypter, error) {
+	if cfg.SessionPoolSize <= 0 {
+		cfg.SessionPoolSize = 4
+	}
+
+	ctx := pkcs11.New(cfg.ModulePath)
+	if ctx == nil {
+		return nil, fmt.Errorf("pkcs11: failed to load module %q", cfg.ModulePath)
+	}
+	if err := ctx.Initialize(); err != nil {
+		return nil, fmt.Errorf("pkcs11: initialize: %v", err)
+	}
+
+	slot, err := findSlotByTokenLabel(ctx, cfg.TokenLabel)
+	if err != nil {
+		ctx.Finalize()
+		return nil, err
+	}
+
+	d := &Decrypter{
+		cfg:  cfg,
+		ctx:  ctx,
+		slot: slot,
+	}
+
+	session, err := d.openSession()
+	if err != nil {
+		ctx.Finalize()
+		return nil, err
+	}
+
+	keyHandle, err := findKeyByLabel(ctx, session, cfg.KeyLabel, pkcs11.CKO_PRIVATE_KEY)
+	if err != nil {
+		d.releaseSession(session)
+		ctx.Finalize()
+		return nil, err
+	}
+	d.keyHandle = keyHandle
+
+	pubHandle, err := findKeyByLabel(ctx, session, cfg.KeyLabel, pkcs11.CKO_PUBLIC_KEY)
+	if err != nil {
+		d.releaseSession(session)
+		ctx.Finalize()
+		return nil, err
+	}
+	pub, err := extractPublicKey(ctx, session, pubHandle)
+	if err != nil {
+		d.releaseSession(session)
+		ctx.Finalize()
+		return nil, err
+	}
+	d.PublicKey = pub
+
+	d.releaseSession(session)
+
+	return d, nil
+}
+
+// Close logs out, closes pooled sessions and finalizes the PKCS#11 module.
+func (d *Decrypter) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, session := range d.sessions {
+		d.ctx.Logout(session)
+		d.ctx.CloseSession(session)
+	}
+	d.sessions = nil
+
+	return d.ctx.Finalize()
+}
+
+// Decrypt implements cryptodata.Decrypter, decrypting ciphertext with
+// CKM_RSA_PKCS_OAEP using a session borrowed from the pool.
+func (d *Decrypter) Decrypt(ciphertext []byte) ([]byte, error) {
+	session, err := d.borrowSession()
+	if err != nil {
+		return nil, err
+	}
+
+	mechanism := oaepMechanism()
+
+	plaintext, err := d.decryptWithSession(session, mechanism, ciphertext)
+	if err == pkcs11.Error(pkcs11.CKR_SESSION_HANDLE_INVALID) {
+		// The borrowed session is dead; release it rather than returning it
+		// to the pool, then retry once with a freshly opened, logged-in
+		// session.
+		d.releaseSession(session)
+
+		session, err = d.openSession()
+		if err != nil {
+			return nil, err
+		}
+		defer d.releaseSession(session)
+		return d.decryptWithSession(session, mechanism, ciphertext)
+	}
+
+	d.returnSession(session)
+	return plaintext, err
+}
+
+func (d *Decrypter) decryptWithSession(session pkcs11.SessionHandle, mechanism []*pkcs11.Mechanism, ciphertext []byte) ([]byte, error) {
+	if err := d.ctx.DecryptInit(session, mechanism, d.keyHandle); err != nil {
+		return nil, err
+	}
+	return d.ctx.Decrypt(session, ciphertext)
+}
+
+func (d *Decrypter) borrowSession() (pkcs11.SessionHandle, error) {
+	d.mu.Lock()
+	if len(d.sessions) > 0 {
+		session := d.sessions[len(d.sessions)-1]
+		d.sessions = d.sessions[:len(d.sessions)-1]
+		d.mu.Unlock()
+		return session, nil
+	}
+	d.mu.Unlock()
+
+	return d.openSession()
+}
+
+func (d *Decrypter) returnSession(session pkcs11.SessionHandle) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(d.sessions) >= d.cfg.SessionPoolSize {
+		d.ctx.CloseSession(session)
+		return
+	}
+	d.sessions = append(d.sessions, session)
+}
+
+// releaseSession closes session without logging out, since a logout would
+// end the login of every other pooled session as well.
+func (d *Decrypter) releaseSession(session pkcs11.SessionHandle) {
+	d.ctx.CloseSession(session)
+}
+
+func (d *Decrypter) openSession() (pkcs11.SessionHandle, error) {
+	session, err := d.ctx.OpenSession(d.slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		return 0, fmt.Errorf("pkcs11: open session: %v", err)
+	}
+	// Login state is shared by all sessions of the token, so a session opened
+	// while another one is logged in is already logged in as well.
+	if err := d.ctx.Login(session, pkcs11.CKU_USER, d.cfg.UserPIN); err != nil && err != pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+		d.ctx.CloseSession(session)
+		return 0, fmt.Errorf("pkcs11: login: %v", err)
+	}
+	return session, nil
+}
+
+// oaepMechanism builds a CKM_RSA_PKCS_OAEP mechanism matching the SHA-256 /
+// MGF1-SHA-256 parameters cryptodata.Client uses by default. Callers using a
+// different client Hash must keep this in sync.
+func oaepMechanism() []*pkcs11.Mechanism {
+	params := pkcs11.NewOAEPParams(pkcs11.CKM_SHA256, pkcs11.CKG_MGF1_SHA256, pkcs11.CKZ_DATA_SPECIFIED, nil)
+	return []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_OAEP, params)}
+}
+
+func findSlotByTokenLabel(ctx *pkcs11.Ctx, label string) (uint, error) {
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		return 0, fmt.Errorf("pkcs11: get slot list: %v", err)
+	}
+
+	for _, slot := range slots {
+		info, err := ctx.GetTokenInfo(slot)
+		if err != nil {
+			continue
+		}
+		if info.Label == label {
+			return slot, nil
+		}
+	}
+
+	return 0, fmt.Errorf("pkcs11: no token found with label %q", label)
+}
+
+func findKeyByLabel(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, label string, class uint) (pkcs11.ObjectHandle, error) {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	}
+
+	if err := ctx.FindObjectsInit(session, template); err != nil {
+		return 0, fmt.Errorf("pkcs11: find objects init: %v", err)
+	}
+	defer ctx.FindObjectsFinal(session)
+
+	objects, _, err := ctx.FindObjects(session, 1)
+	if err != nil {
+		return 0, fmt.Errorf("pkcs11: find objects: %v", err)
+	}
+	if len(objects) == 0 {
+		return 0, fmt.Errorf("pkcs11: no object found with label %q and class %d", label, class)
+	}
+
+	return objects[0], nil
+}
+
+func extractPublicKey(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, handle pkcs11.ObjectHandle) (*rsa.PublicKey, error) {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+	}
+
+	attrs, err := ctx.GetAttributeValue(session, handle, template)
+	if err != nil {
+		return nil, fmt.Errorf("pkcs11: get attribute value: %v", err)
+	}
+	if len(attrs) != 2 {
+		return nil, errors.New("pkcs11: unexpected number of attributes returned for public key")
+	}
+
+	modulus := new(big.Int).SetBytes(attrs[0].Value)
+	exponent := new(big.Int).SetBytes(attrs[1].Value)
+
+	return &rsa.PublicKey{
+		N: modulus,
+		E: int(exponent.Int64()),
+	}, nil
+}
@@ -0,0 +1,348 @@
+//  Copyright (c) 2019 Cisco and/or its affiliates.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at:
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+// Package vault implements a cryptodata.KeyProvider backed by Hashicorp
+// Vault. RSA private keys are stored as PEM-encoded secrets under a KV
+// version 2 mount; every secret version under SecretPath is treated as one
+// key, which allows operators to rotate keys by simply writing a new
+// version and letting agents pick it up on the next poll.
+package vault
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// AuthMethod selects how Provider authenticates to Vault.
+type AuthMethod string
+
+const (
+	// AuthMethodToken authenticates using a static Vault token.
+	AuthMethodToken AuthMethod = "token"
+	// AuthMethodAppRole authenticates using the AppRole auth method.
+	AuthMethodAppRole AuthMethod = "approle"
+	// AuthMethodKubernetes authenticates using the Kubernetes auth method.
+	AuthMethodKubernetes AuthMethod = "kubernetes"
+)
+
+// Config configures the Vault-backed KeyProvider.
+type Config struct {
+	// VaultAddress is the address of the Vault server, e.g. "https://vault:8200".
+	VaultAddress string `json:"vault-address"`
+
+	// AuthMethod selects the authentication method used to log in to Vault.
+	AuthMethod AuthMethod `json:"auth-method"`
+
+	// Token is the Vault token used when AuthMethod is AuthMethodToken.
+	Token string `json:"token"`
+
+	// RoleID and SecretID are used when AuthMethod is AuthMethodAppRole.
+	RoleID   string `json:"role-id"`
+	SecretID string `json:"secret-id"`
+
+	// KubernetesRole and KubernetesJWTPath are used when AuthMethod is
+	// AuthMethodKubernetes. KubernetesJWTPath defaults to the projected
+	// service account token path if unset.
+	KubernetesRole    string `json:"kubernetes-role"`
+	KubernetesJWTPath string `json:"kubernetes-jwt-path"`
+
+	// SecretPath is the path to a KV v2 secret, e.g. "secret/data/agent/keys".
+	// Every version of the secret present there is loaded as a private key.
+	SecretPath string `json:"secret-path"`
+
+	// RenewIncrement is the requested lease renewal increment. Defaults to
+	// 1 hour.
+	RenewIncrement time.Duration `json:"renew-increment"`
+
+	// PollInterval is how often the provider checks SecretPath for new
+	// secret versions. Defaults to 1 minute.
+	PollInterval time.Duration `json:"poll-interval"`
+
+	// TLSSkipVerify disables TLS certificate verification for the Vault
+	// client. Only use this for local development.
+	TLSSkipVerify bool `json:"tls-skip-verify"`
+}
+
+const defaultSecretDataKey = "private_key"
+
+// Provider is a cryptodata.KeyProvider that fetches RSA private keys from
+// Hashicorp Vault.
+type Provider struct {
+	cfg    Config
+	client *api.Client
+
+	mu        sync.Mutex
+	latestVer int
+}
+
+// NewProvider creates a Provider for the given Config and logs in to Vault
+// using the configured AuthMethod.
+func NewProvider(cfg Config) (*Provider, error) {
+	if cfg.RenewIncrement <= 0 {
+		cfg.RenewIncrement = time.Hour
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = time.Minute
+	}
+
+	vaultCfg := api.DefaultConfig()
+	vaultCfg.Address = cfg.VaultAddress
+	if cfg.TLSSkipVerify {
+		if err := vaultCfg.ConfigureTLS(&api.TLSConfig{Insecure: true}); err != nil {
+			return nil, err
+		}
+	}
+
+	client, err := api.NewClient(vaultCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Provider{
+		cfg:    cfg,
+		client: client,
+	}
+
+	if err := p.login(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func (p *Provider) login() error {
+	switch p.cfg.AuthMethod {
+	case AuthMethodToken:
+		if p.cfg.Token == "" {
+			return errors.New("vault: token auth requires Token to be set")
+		}
+		p.client.SetToken(p.cfg.Token)
+		return nil
+
+	case AuthMethodAppRole:
+		secret, err := p.client.Logical().Write("auth/approle/login", map[string]interface{}{
+			"role_id":   p.cfg.RoleID,
+			"secret_id": p.cfg.SecretID,
+		})
+		if err != nil {
+			return fmt.Errorf("vault: approle login failed: %v", err)
+		}
+		return p.applyAuthSecret(secret)
+
+	case AuthMethodKubernetes:
+		jwtPath := p.cfg.KubernetesJWTPath
+		if jwtPath == "" {
+			jwtPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+		}
+		jwt, err := readFile(jwtPath)
+		if err != nil {
+			return fmt.Errorf("vault: reading kubernetes service account token: %v", err)
+		}
+		secret, err := p.client.Logical().Write("auth/kubernetes/login", map[string]interface{}{
+			"role": p.cfg.KubernetesRole,
+			"jwt":  jwt,
+		})
+		if err != nil {
+			return fmt.Errorf("vault: kubernetes login failed: %v", err)
+		}
+		return p.applyAuthSecret(secret)
+
+	default:
+		return fmt.Errorf("vault: unsupported auth method %q", p.cfg.AuthMethod)
+	}
+}
+
+func (p *Provider) applyAuthSecret(secret *api.Secret) error {
+	if secret == nil || secret.Auth == nil || secret.Auth.ClientToken == "" {
+		return errors.New("vault: login response did not contain a client token")
+	}
+	p.client.SetToken(secret.Auth.ClientToken)
+	return nil
+}
+
+// PrivateKeys reads every version of the configured secret and parses each
+// one as a PEM-encoded RSA private key.
+func (p *Provider) PrivateKeys(ctx context.Context) ([]*rsa.PrivateKey, error) {
+	metadata, err := p.client.Logical().ReadWithContext(ctx, metadataPath(p.cfg.SecretPath))
+	if err != nil {
+		return nil, fmt.Errorf("vault: reading secret metadata: %v", err)
+	}
+	if metadata == nil || metadata.Data == nil {
+		return nil, fmt.Errorf("vault: no metadata found at %s", p.cfg.SecretPath)
+	}
+
+	versions, ok := metadata.Data["versions"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("vault: unexpected metadata format at %s", p.cfg.SecretPath)
+	}
+
+	var keys []*rsa.PrivateKey
+	var maxVersion int
+	for verStr := range versions {
+		ver, err := strconv.Atoi(verStr)
+		if err != nil {
+			continue
+		}
+
+		dataPath, params := versionedDataPath(p.cfg.SecretPath, ver)
+		secret, err := p.client.Logical().ReadWithDataWithContext(ctx, dataPath, params)
+		if err != nil || secret == nil || secret.Data == nil {
+			continue
+		}
+		data, _ := secret.Data["data"].(map[string]interface{})
+		pemStr, _ := data[defaultSecretDataKey].(string)
+		if pemStr == "" {
+			continue
+		}
+
+		key, err := parsePrivateKey(pemStr)
+		if err != nil {
+			continue
+		}
+
+		keys = append(keys, key)
+		if ver > maxVersion {
+			maxVersion = ver
+		}
+	}
+
+	p.mu.Lock()
+	p.latestVer = maxVersion
+	p.mu.Unlock()
+
+	return keys, nil
+}
+
+// Watch polls SecretPath for new secret versions and renews the Vault
+// lease/token on cfg.RenewIncrement. It blocks until ctx is cancelled, or
+// until a renewal fails and the re-login that follows it fails too.
+func (p *Provider) Watch(ctx context.Context, onRotate func()) error {
+	renewTicker := time.NewTicker(p.cfg.RenewIncrement)
+	defer renewTicker.Stop()
+
+	pollTicker := time.NewTicker(p.cfg.PollInterval)
+	defer pollTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case <-renewTicker.C:
+			if _, err := p.client.Auth().Token().RenewSelfWithContext(ctx, int(p.cfg.RenewIncrement.Seconds())); err != nil {
+				// Token may no longer be renewable (e.g. AppRole/Kubernetes
+				// tokens with a capped TTL); re-login and keep going.
+				if err := p.login(); err != nil {
+					return fmt.Errorf("vault: re-login after renewal failure: %v", err)
+				}
+			}
+
+		case <-pollTicker.C:
+			metadata, err := p.client.Logical().ReadWithContext(ctx, metadataPath(p.cfg.SecretPath))
+			if err != nil || metadata == nil || metadata.Data == nil {
+				continue
+			}
+			current, _ := metadata.Data["current_version"].(interface{})
+			curVer, _ := toInt(current)
+
+			p.mu.Lock()
+			rotated := curVer > p.latestVer
+			p.mu.Unlock()
+
+			if rotated {
+				onRotate()
+			}
+		}
+	}
+}
+
+func parsePrivateKey(pemStr string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(pemStr))
+	if block == nil {
+		return nil, errors.New("vault: failed to decode PEM block")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("vault: secret does not contain an RSA private key")
+	}
+	return rsaKey, nil
+}
+
+func metadataPath(secretPath string) string {
+	return rewriteDataPath(secretPath, "metadata")
+}
+
+// versionedDataPath returns the KV v2 data path for secretPath together with
+// the query parameters that select the given version.
+func versionedDataPath(secretPath string, version int) (string, map[string][]string) {
+	return rewriteDataPath(secretPath, "data"), map[string][]string{"version": {strconv.Itoa(version)}}
+}
+
+// rewriteDataPath swaps the "data" segment of a KV v2 path (e.g.
+// "secret/data/agent/keys") for the given segment, so callers can request
+// the "metadata" endpoint for a path configured for "data" reads.
+func rewriteDataPath(secretPath, segment string) string {
+	const marker = "/data/"
+	if i := strings.Index(secretPath, marker); i >= 0 {
+		mount := secretPath[:i]
+		rest := secretPath[i+len(marker):]
+		return fmt.Sprintf("%s/%s/%s", mount, segment, rest)
+	}
+	return secretPath
+}
+
+func readFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func toInt(v interface{}) (int, error) {
+	switch n := v.(type) {
+	case int:
+		return n, nil
+	case float64:
+		return int(n), nil
+	case json.Number:
+		i, err := n.Int64()
+		return int(i), err
+	case string:
+		return strconv.Atoi(n)
+	default:
+		return 0, fmt.Errorf("vault: cannot convert %T to int", v)
+	}
+}
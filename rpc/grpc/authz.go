@@ -0,0 +1,132 @@
+// Copyright (c) 2019 Cisco and/or its affiliates.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpc
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Authorizer is an opt-in authorization hook evaluated for every RPC once
+// AuthzEnabled is set. It is typically backed by a policy engine such as
+// Casbin (see the casbin subpackage).
+type Authorizer interface {
+	// Authorize returns nil if the caller identified by the peer metadata
+	// (subject is extracted by the interceptor, see SubjectFromContext) is
+	// allowed to invoke fullMethod, or a non-nil error otherwise.
+	Authorize(ctx context.Context, fullMethod string, md metadata.MD) error
+}
+
+var (
+	authzDecisionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "grpc",
+		Subsystem: "authz",
+		Name:      "decisions_total",
+		Help:      "Total number of gRPC authorization decisions by method and result.",
+	}, []string{"method", "result"})
+)
+
+func init() {
+	prometheus.MustRegister(authzDecisionsTotal)
+}
+
+func (cfg *Config) unaryAuthzInterceptor(authorizer Authorizer) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := cfg.authorize(ctx, authorizer, info.FullMethod); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func (cfg *Config) streamAuthzInterceptor(authorizer Authorizer) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := cfg.authorize(ss.Context(), authorizer, info.FullMethod); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
+
+// SubjectMetadataKey is the metadata key under which the interceptor-resolved
+// caller subject (see SubjectFromContext) is made available to an Authorizer
+// implementation via the md argument of Authorize.
+const SubjectMetadataKey = "grpc-authz-subject"
+
+func (cfg *Config) authorize(ctx context.Context, authorizer Authorizer, fullMethod string) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	md = md.Copy()
+	md.Set(SubjectMetadataKey, cfg.SubjectFromContext(ctx))
+
+	err := authorizer.Authorize(ctx, fullMethod, md)
+	if cfg.PrometheusMetrics {
+		result := "allow"
+		if err != nil {
+			result = "deny"
+		}
+		authzDecisionsTotal.WithLabelValues(fullMethod, result).Inc()
+	}
+	if err != nil {
+		return status.Errorf(codes.PermissionDenied, "authorization denied for %s: %v", fullMethod, err)
+	}
+
+	return nil
+}
+
+// SubjectFromContext resolves the calling subject for an RPC. It prefers the
+// CommonName or first URI SAN (e.g. a SPIFFE URI) of the peer's verified TLS
+// client certificate; if no client certificate was presented it falls back
+// to the cfg.AuthzSubjectHeader metadata header.
+func (cfg *Config) SubjectFromContext(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok {
+		if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			if subject := subjectFromCertificate(tlsInfo); subject != "" {
+				return subject
+			}
+		}
+	}
+
+	if cfg.AuthzSubjectHeader == "" {
+		return ""
+	}
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	values := md.Get(cfg.AuthzSubjectHeader)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func subjectFromCertificate(tlsInfo credentials.TLSInfo) string {
+	if len(tlsInfo.State.PeerCertificates) == 0 {
+		return ""
+	}
+	cert := tlsInfo.State.PeerCertificates[0]
+
+	if len(cert.URIs) > 0 {
+		return cert.URIs[0].String()
+	}
+	return cert.Subject.CommonName
+}
@@ -0,0 +1,201 @@
+// Copyright (c) 2019 Cisco and/or its affiliates.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package casbin implements a grpc.Authorizer on top of a Casbin enforcer,
+// so gRPC method access can be controlled by a model+policy pair instead of
+// hand-written interceptor logic.
+package casbin
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/casbin/casbin/v2"
+	"google.golang.org/grpc/metadata"
+
+	"go.ligato.io/cn-infra/v2/db/keyval"
+	grpcplugin "go.ligato.io/cn-infra/v2/rpc/grpc"
+)
+
+// Action is the Casbin action used for every gRPC call. There is only one
+// kind of action an RPC can perform, so this keeps policy files simple:
+// "subject, fullMethod, invoke".
+const Action = "invoke"
+
+// Config configures the Casbin-backed Authorizer.
+type Config struct {
+	// ModelFile is the path to the Casbin model (.conf) file.
+	ModelFile string
+	// PolicyFile is the path to a Casbin policy CSV file. Ignored if
+	// KeyvalWatcher is set.
+	PolicyFile string
+	// KeyvalWatcher, when set, is used instead of PolicyFile: the policy CSV
+	// is read from, and live-reloaded from, PolicyKeyPrefix in the
+	// underlying datastore.
+	KeyvalWatcher keyval.BytesWatcher
+	// PolicyKeyPrefix is the keyval key holding the policy CSV, used when
+	// KeyvalWatcher is set.
+	PolicyKeyPrefix string
+}
+
+// Authorizer is a grpcplugin.Authorizer backed by a Casbin enforcer.
+type Authorizer struct {
+	cfg Config
+
+	mu       sync.RWMutex
+	enforcer *casbin.Enforcer
+}
+
+// NewAuthorizer loads the Casbin model and policy and, if cfg.KeyvalWatcher
+// is set, starts watching PolicyKeyPrefix for live policy updates.
+func NewAuthorizer(cfg Config) (*Authorizer, error) {
+	a := &Authorizer{cfg: cfg}
+
+	if err := a.loadFromFile(); err != nil && cfg.KeyvalWatcher == nil {
+		return nil, err
+	}
+
+	if cfg.KeyvalWatcher != nil {
+		if err := a.loadFromKeyval(); err != nil {
+			return nil, err
+		}
+		if err := a.watchKeyval(); err != nil {
+			return nil, err
+		}
+	}
+
+	return a, nil
+}
+
+// NewAuthorizerFromGRPCConfig builds an Authorizer from a grpc.Config's
+// authz fields: AuthzModelFile becomes Config.ModelFile, and
+// AuthzPolicySource becomes either Config.PolicyFile or, when
+// AuthzPolicyFromKeyval is set, Config.PolicyKeyPrefix (read and
+// live-reloaded through keyvalWatcher). This is the glue operators use to go
+// from grpc.Config to a grpc.Authorizer they can pass to getGrpcOptions:
+//
+//	authorizer, err := casbin.NewAuthorizerFromGRPCConfig(cfg, watcher)
+func NewAuthorizerFromGRPCConfig(cfg grpcplugin.Config, keyvalWatcher keyval.BytesWatcher) (*Authorizer, error) {
+	c := Config{
+		ModelFile: cfg.AuthzModelFile,
+	}
+
+	if cfg.AuthzPolicyFromKeyval {
+		c.KeyvalWatcher = keyvalWatcher
+		c.PolicyKeyPrefix = cfg.AuthzPolicySource
+	} else {
+		c.PolicyFile = cfg.AuthzPolicySource
+	}
+
+	return NewAuthorizer(c)
+}
+
+func (a *Authorizer) loadFromFile() error {
+	enforcer, err := casbin.NewEnforcer(a.cfg.ModelFile, a.cfg.PolicyFile)
+	if err != nil {
+		return fmt.Errorf("casbin: loading model/policy: %v", err)
+	}
+
+	a.mu.Lock()
+	a.enforcer = enforcer
+	a.mu.Unlock()
+
+	return nil
+}
+
+func (a *Authorizer) loadFromKeyval() error {
+	_, value, found, err := a.cfg.KeyvalWatcher.GetValue(a.cfg.PolicyKeyPrefix)
+	if err != nil {
+		return fmt.Errorf("casbin: reading policy from keyval: %v", err)
+	}
+	if !found {
+		return fmt.Errorf("casbin: no policy found at key %q", a.cfg.PolicyKeyPrefix)
+	}
+
+	return a.reloadPolicy(value)
+}
+
+func (a *Authorizer) reloadPolicy(policyCSV []byte) error {
+	enforcer, err := casbin.NewEnforcer(a.cfg.ModelFile)
+	if err != nil {
+		return fmt.Errorf("casbin: loading model: %v", err)
+	}
+	adapter := newCSVBytesAdapter(policyCSV)
+	enforcer.SetAdapter(adapter)
+	if err := enforcer.LoadPolicy(); err != nil {
+		return fmt.Errorf("casbin: loading policy from keyval: %v", err)
+	}
+
+	a.mu.Lock()
+	a.enforcer = enforcer
+	a.mu.Unlock()
+
+	return nil
+}
+
+func (a *Authorizer) watchKeyval() error {
+	respChan := make(chan keyval.BytesWatchResp)
+	if err := a.cfg.KeyvalWatcher.Watch(respChan, a.cfg.PolicyKeyPrefix); err != nil {
+		return fmt.Errorf("casbin: watching policy key: %v", err)
+	}
+
+	go func() {
+		for resp := range respChan {
+			if resp.GetChangeType() == keyval.Delete {
+				continue
+			}
+			_ = a.reloadPolicy(resp.GetValue())
+		}
+	}()
+
+	return nil
+}
+
+// Authorize implements grpcplugin.Authorizer, reading the subject that the
+// grpc interceptor resolved (from the peer's client certificate or the
+// configured metadata header) out of md under grpcplugin.SubjectMetadataKey
+// and asking the Casbin enforcer whether it may invoke fullMethod.
+func (a *Authorizer) Authorize(ctx context.Context, fullMethod string, md metadata.MD) error {
+	subject := subjectFromMetadata(md)
+	if subject == "" {
+		return fmt.Errorf("casbin: no subject could be resolved for %s", fullMethod)
+	}
+
+	a.mu.RLock()
+	enforcer := a.enforcer
+	a.mu.RUnlock()
+
+	allowed, err := enforcer.Enforce(subject, fullMethod, Action)
+	if err != nil {
+		return fmt.Errorf("casbin: enforce failed: %v", err)
+	}
+	if !allowed {
+		return fmt.Errorf("subject %q is not authorized to invoke %s", subject, fullMethod)
+	}
+
+	return nil
+}
+
+// subjectFromMetadata returns the subject stored in md under
+// grpcplugin.SubjectMetadataKey, where the grpc interceptor puts the result
+// of grpcplugin.Config.SubjectFromContext. It returns "" if the key is
+// absent.
+func subjectFromMetadata(md metadata.MD) string {
+	values := md.Get(grpcplugin.SubjectMetadataKey)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
@@ -0,0 +1,215 @@
+// Copyright (c) 2019 Cisco and/or its affiliates.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"go.ligato.io/cn-infra/v2/logging/logrus"
+)
+
+const (
+	defaultAutoTLSValidity = 90 * 24 * time.Hour
+
+	autoTLSCertFile = "auto-tls-cert.pem"
+	autoTLSKeyFile  = "auto-tls-key.pem"
+	autoTLSCAFile   = "ca.pem"
+)
+
+// getAutoTLS returns a TLS config using either a self-signed certificate
+// persisted under AutoTLSDir, or, when AutoTLSACMEDirectory is set, a
+// certificate obtained from that ACME directory.
+func (cfg *Config) getAutoTLS() (*tls.Config, error) {
+	if cfg.AutoTLSACMEDirectory != "" {
+		return cfg.getACMETLS()
+	}
+
+	cert, err := cfg.loadOrGenerateSelfSigned()
+	if err != nil {
+		return nil, err
+	}
+
+	tc := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+
+	if err := cfg.applyClientCAs(tc); err != nil {
+		return nil, err
+	}
+
+	return tc, nil
+}
+
+func (cfg *Config) getACMETLS() (*tls.Config, error) {
+	if err := os.MkdirAll(cfg.AutoTLSDir, 0700); err != nil {
+		return nil, fmt.Errorf("auto-tls: creating cache dir: %v", err)
+	}
+
+	hosts := cfg.autoTLSHosts()
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cfg.AutoTLSDir),
+		HostPolicy: autocert.HostWhitelist(hosts...),
+		Client: &acme.Client{
+			DirectoryURL: cfg.AutoTLSACMEDirectory,
+		},
+	}
+
+	tc := m.TLSConfig()
+	tc.MinVersion = tls.VersionTLS12
+
+	if err := cfg.applyClientCAs(tc); err != nil {
+		return nil, err
+	}
+
+	return tc, nil
+}
+
+// loadOrGenerateSelfSigned reuses the certificate persisted under
+// AutoTLSDir as long as it is still valid for at least a third of its
+// original validity period; otherwise it generates and persists a new one.
+func (cfg *Config) loadOrGenerateSelfSigned() (tls.Certificate, error) {
+	certPath := filepath.Join(cfg.AutoTLSDir, autoTLSCertFile)
+	keyPath := filepath.Join(cfg.AutoTLSDir, autoTLSKeyFile)
+
+	_, existed := os.Stat(certPath)
+	if cert, ok := cfg.loadValidSelfSigned(certPath, keyPath); ok {
+		return cert, nil
+	}
+	if existed == nil {
+		logrus.DefaultLogger().Warnf("auto-tls: certificate at %s is missing, unreadable or nearing expiry, regenerating", certPath)
+	}
+
+	return cfg.generateSelfSigned(certPath, keyPath)
+}
+
+func (cfg *Config) loadValidSelfSigned(certPath, keyPath string) (tls.Certificate, bool) {
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return tls.Certificate{}, false
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return tls.Certificate{}, false
+	}
+
+	validity := leaf.NotAfter.Sub(leaf.NotBefore)
+	remaining := time.Until(leaf.NotAfter)
+	if remaining <= validity/3 {
+		return tls.Certificate{}, false
+	}
+
+	return cert, true
+}
+
+func (cfg *Config) generateSelfSigned(certPath, keyPath string) (tls.Certificate, error) {
+	validity := cfg.AutoTLSValidity
+	if validity <= 0 {
+		validity = defaultAutoTLSValidity
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("auto-tls: generating key: %v", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("auto-tls: generating serial number: %v", err)
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "cn-infra-auto-tls"},
+		NotBefore:             now,
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+
+	for _, host := range cfg.autoTLSHosts() {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("auto-tls: creating certificate: %v", err)
+	}
+
+	keyBytes, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("auto-tls: marshaling key: %v", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes})
+
+	if err := os.MkdirAll(cfg.AutoTLSDir, 0700); err != nil {
+		return tls.Certificate{}, fmt.Errorf("auto-tls: creating dir: %v", err)
+	}
+	if err := ioutil.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return tls.Certificate{}, fmt.Errorf("auto-tls: writing key: %v", err)
+	}
+	if err := ioutil.WriteFile(certPath, certPEM, 0600); err != nil {
+		return tls.Certificate{}, fmt.Errorf("auto-tls: writing certificate: %v", err)
+	}
+	// ca.pem carries no private key material and is meant to be trusted by
+	// other clients/tools on the host, so it is world-readable unlike the
+	// key and certificate above.
+	if err := ioutil.WriteFile(filepath.Join(cfg.AutoTLSDir, autoTLSCAFile), certPEM, 0644); err != nil {
+		return tls.Certificate{}, fmt.Errorf("auto-tls: writing ca.pem: %v", err)
+	}
+
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// autoTLSHosts returns the configured AutoTLSHosts, defaulting to the
+// machine hostname plus the loopback addresses.
+func (cfg *Config) autoTLSHosts() []string {
+	if len(cfg.AutoTLSHosts) > 0 {
+		return cfg.AutoTLSHosts
+	}
+
+	hosts := []string{"127.0.0.1", "::1"}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		hosts = append(hosts, hostname)
+	}
+	return hosts
+}
@@ -61,12 +61,53 @@ type Config struct {
 	Keyfile           string   `json:"key-file"`
 	CAfiles           []string `json:"ca-files"`
 
+	// AutoTLS generates and persists a TLS certificate when Certfile and
+	// Keyfile are both empty, instead of requiring operators to provision
+	// one upfront. See getAutoTLS for details.
+	AutoTLS bool `json:"auto-tls"`
+	// AutoTLSDir is where the generated key, certificate (and, for the ACME
+	// path, the autocert cache) are persisted across restarts.
+	AutoTLSDir string `json:"auto-tls-dir"`
+	// AutoTLSHosts are the SANs the generated certificate is valid for.
+	// Defaults to the machine hostname plus 127.0.0.1 and ::1.
+	AutoTLSHosts []string `json:"auto-tls-hosts"`
+	// AutoTLSValidity is how long a self-signed certificate is valid for.
+	// Defaults to 90 days. Ignored when AutoTLSACMEDirectory is set.
+	AutoTLSValidity time.Duration `json:"auto-tls-validity"`
+	// AutoTLSACMEDirectory, when set, switches AutoTLS to obtain a real
+	// certificate for AutoTLSHosts from the given ACME directory URL
+	// (e.g. Let's Encrypt) instead of generating a self-signed one.
+	AutoTLSACMEDirectory string `json:"auto-tls-acme-directory"`
+
 	// ExtendedLogging enables detailed GRPC logging
 	ExtendedLogging bool `json:"extended-logging"`
 
 	// PrometheusMetrics enables prometheus metrics for gRPC client.
 	PrometheusMetrics bool `json:"prometheus-metrics"`
 
+	// AuthzEnabled turns on the authorization interceptor. getGrpcOptions
+	// returns an error if it is set and no Authorizer is passed; see Authorizer.
+	// AuthzModelFile, AuthzPolicySource and AuthzPolicyFromKeyval are not
+	// read by this package directly: they are the inputs to
+	// casbin.NewAuthorizerFromGRPCConfig (rpc/grpc/authz/casbin), which
+	// builds the Authorizer to pass to getGrpcOptions from them.
+	AuthzEnabled bool `json:"authz-enabled"`
+	// AuthzModelFile is the path to a Casbin model file. See
+	// casbin.NewAuthorizerFromGRPCConfig.
+	AuthzModelFile string `json:"authz-model-file"`
+	// AuthzPolicySource is either a path to a Casbin policy CSV file, or,
+	// when AuthzPolicyFromKeyval is set, a keyval key prefix holding the
+	// policy so it can be live-reloaded without a restart. See
+	// casbin.NewAuthorizerFromGRPCConfig.
+	AuthzPolicySource string `json:"authz-policy-source"`
+	// AuthzPolicyFromKeyval treats AuthzPolicySource as a keyval key prefix
+	// instead of a file path. See casbin.NewAuthorizerFromGRPCConfig.
+	AuthzPolicyFromKeyval bool `json:"authz-policy-from-keyval"`
+	// AuthzSubjectHeader is a metadata header carrying the caller's subject,
+	// used when the connection is not authenticated with a client
+	// certificate (e.g. insecure or AutoTLS-without-ClientCAs transport).
+	AuthzSubjectHeader string `json:"authz-subject-header"`
+
 	// Compression for inbound/outbound messages.
 	// Supported only gzip.
 	//TODO Compression string
@@ -81,7 +122,17 @@ type Config struct {
 	KeepaliveMaxConnectionIdle   uint32 `json:"keepalive-max-connection-idle"`
 }
 
-func (cfg *Config) getGrpcOptions() (opts []grpc.ServerOption) {
+func (cfg *Config) getGrpcOptions(authorizer Authorizer) (opts []grpc.ServerOption, err error) {
+	if cfg.AuthzEnabled {
+		if authorizer == nil {
+			return nil, fmt.Errorf("grpc: AuthzEnabled is set but no Authorizer was provided")
+		}
+		opts = append(opts,
+			grpc.UnaryInterceptor(cfg.unaryAuthzInterceptor(authorizer)),
+			grpc.StreamInterceptor(cfg.streamAuthzInterceptor(authorizer)),
+		)
+	}
+
 	if cfg.MaxConcurrentStreams > 0 {
 		opts = append(opts, grpc.MaxConcurrentStreams(cfg.MaxConcurrentStreams))
 	}
@@ -130,8 +181,13 @@ func (cfg *Config) getTLS() (*tls.Config, error) {
 	if cfg.InsecureTransport {
 		return nil, nil
 	}
-	// Minimal requirement is to get cert and key for enabling TLS.
+
+	// No static cert/key configured: either bootstrap one via AutoTLS, or
+	// run without TLS for backward compatibility.
 	if cfg.Certfile == "" && cfg.Keyfile == "" {
+		if cfg.AutoTLS {
+			return cfg.getAutoTLS()
+		}
 		return nil, nil
 	}
 
@@ -144,24 +200,35 @@ func (cfg *Config) getTLS() (*tls.Config, error) {
 		Certificates: []tls.Certificate{cert},
 	}
 
-	// Check if we want verify client's certificate against custom CA
-	if len(cfg.CAfiles) > 0 {
-		caCertPool := x509.NewCertPool()
-		for _, c := range cfg.CAfiles {
-			cert, err := ioutil.ReadFile(c)
-			if err != nil {
-				return nil, err
-			}
+	if err := cfg.applyClientCAs(tc); err != nil {
+		return nil, err
+	}
 
-			if !caCertPool.AppendCertsFromPEM(cert) {
-				return nil, fmt.Errorf("failed to add CA from '%s' file", c)
-			}
+	return tc, nil
+}
+
+// applyClientCAs configures tc to verify client certificates against
+// cfg.CAfiles, if any are set.
+func (cfg *Config) applyClientCAs(tc *tls.Config) error {
+	if len(cfg.CAfiles) == 0 {
+		return nil
+	}
+
+	caCertPool := x509.NewCertPool()
+	for _, c := range cfg.CAfiles {
+		cert, err := ioutil.ReadFile(c)
+		if err != nil {
+			return err
+		}
+
+		if !caCertPool.AppendCertsFromPEM(cert) {
+			return fmt.Errorf("failed to add CA from '%s' file", c)
 		}
-		tc.ClientCAs = caCertPool
-		tc.ClientAuth = tls.RequireAndVerifyClientCert
 	}
+	tc.ClientCAs = caCertPool
+	tc.ClientAuth = tls.RequireAndVerifyClientCert
 
-	return tc, nil
+	return nil
 }
 
 func (cfg *Config) getSocketType() string {